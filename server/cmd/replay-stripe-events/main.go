@@ -0,0 +1,80 @@
+// Command replay-stripe-events re-runs webhook events that were parked
+// because they arrived for a Stripe subscription we didn't know about yet
+// (see StripeController.parkEvent). Normally these drain automatically once
+// the corresponding "checkout.session.completed" event is processed, but
+// this is a manual escape hatch for subscriptions that got stuck, e.g.
+// because the draining attempt itself failed.
+//
+// Usage:
+//
+//	go run ./cmd/replay-stripe-events -subscription sub_xxx
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/pkg/controller"
+	"github.com/ente-io/museum/pkg/repo"
+	"github.com/ente-io/museum/pkg/repo/referral"
+	log "github.com/sirupsen/logrus"
+	_ "github.com/lib/pq"
+	"github.com/spf13/viper"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+func main() {
+	stripeSubscriptionID := flag.String("subscription", "", "Stripe subscription ID to replay parked events for")
+	flag.Parse()
+	if *stripeSubscriptionID == "" {
+		log.Fatal("-subscription is required")
+	}
+
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Build a real StripeController via NewStripeController rather than a
+	// bare struct literal: drainParkedEvents dispatches into the same
+	// handlers the webhook endpoint uses, and those dereference
+	// StripeClients/UserRepo/DunningCtrl/ReferralRepo, all of which
+	// NewStripeController wires up for us.
+	//
+	// StorageBonusRepo, DiscordController, EmailNotificationCtrl,
+	// OfferController and CommonBillCtrl are left nil; none of the handlers
+	// that park events use them. BillingPlansPerAccount is passed empty, so
+	// replaying a "customer.subscription.updated" for an active
+	// subscription fails its plan lookup. A failed replay puts that event
+	// and the ones after it back in the pending queue.
+	billingRepo := &repo.BillingRepository{DB: db}
+	userRepo := &repo.UserRepository{DB: db}
+	fileRepo := &repo.FileRepository{DB: db}
+	referralRepo := referral.NewRepository(db)
+	stripeClients := stripeClientsFromConfig()
+	stripeController := controller.NewStripeController(
+		ente.BillingPlansPerAccount{}, stripeClients, billingRepo, fileRepo, userRepo,
+		nil, referralRepo, nil, nil, nil, nil)
+	if err = stripeController.ReplayParkedEvents(*stripeSubscriptionID); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Replayed parked events for stripeSubscriptionID=%s", *stripeSubscriptionID)
+}
+
+// stripeClientsFromConfig builds a Stripe API client per account country,
+// keyed the same way as the webhook secrets in stripe.go
+// (stripe.us.webhook-secret / stripe.in.webhook-secret).
+func stripeClientsFromConfig() ente.StripeClientPerAccount {
+	clients := ente.StripeClientPerAccount{}
+	for _, country := range []ente.StripeAccountCountry{"US", "IN"} {
+		apiKey := viper.GetString("stripe." + strings.ToLower(string(country)) + ".key")
+		sc := &client.API{}
+		sc.Init(apiKey, nil)
+		clients[country] = sc
+	}
+	return clients
+}
@@ -0,0 +1,20 @@
+package ente
+
+// BillingPlan is a single Stripe price we sell, under a given Stripe
+// account (and therefore a given StripeAccountCountry).
+type BillingPlan struct {
+	Storage int64
+	// StripeID is the Stripe price ID for this plan.
+	StripeID string
+	// Currency is the ISO currency code this plan's StripeID is
+	// denominated in, so that PlansForCurrency can offer a user only the
+	// plans that'll actually be charged in their display currency rather
+	// than conflating plans across currencies that happen to share an
+	// account.
+	Currency string
+}
+
+// BillingPlansPerAccount maps a Stripe account country to the billing
+// periods (e.g. "month", "year") we sell under it, and the plans available
+// for each period.
+type BillingPlansPerAccount map[StripeAccountCountry]map[string][]BillingPlan
@@ -0,0 +1,24 @@
+package ente
+
+import "time"
+
+// PastDueSubscription is a subscription that is currently being tracked by
+// the dunning cron because Stripe has reported it as `past_due`.
+type PastDueSubscription struct {
+	UserID               int64
+	StripeAccountCountry StripeAccountCountry
+	LatestInvoiceID      string
+	FirstPastDueAt       time.Time
+	// LastReminderDay is the last entry of DunningReminderDays we've already
+	// sent an email for, so the cron doesn't resend the same reminder on
+	// every hourly run it's still on.
+	LastReminderDay int
+}
+
+// PastDueReminderEmailSubject is the subject used for the escalating
+// reminder emails sent while a subscription is past due.
+const PastDueReminderEmailSubject = "Action required: your ente subscription payment failed"
+
+// PastDueReminderEmailTemplate is the mailer template used for the
+// escalating reminder emails sent while a subscription is past due.
+const PastDueReminderEmailTemplate = "past-due-reminder.html"
@@ -0,0 +1,8 @@
+package ente
+
+import "github.com/stripe/stripe-go/v72/client"
+
+// StripeClientPerAccount maps a Stripe account country to the API client
+// authenticated against that account, so that callers can route a request
+// to the right Stripe account without threading an API key around.
+type StripeClientPerAccount map[StripeAccountCountry]*client.API
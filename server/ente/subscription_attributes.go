@@ -0,0 +1,30 @@
+package ente
+
+// StripeAccountCountry identifies which of our Stripe accounts a
+// subscription or price belongs to. We operate a separate Stripe account
+// per country/region so that payouts and tax handling stay local to it.
+type StripeAccountCountry string
+
+// DefaultStripeAccountCountry is the account a user is billed under when
+// they don't already have a Stripe subscription that pins them to one.
+const DefaultStripeAccountCountry StripeAccountCountry = "US"
+
+// SubscriptionAttributes holds payment-provider-specific details about a
+// subscription, persisted as the `attributes` jsonb column on the
+// subscriptions table.
+type SubscriptionAttributes struct {
+	CustomerID           string               `json:"customerID"`
+	IsCancelled          bool                 `json:"isCancelled"`
+	StripeAccountCountry StripeAccountCountry `json:"stripeAccountCountry"`
+	// CancelAtPeriodEnd is true when the subscription is scheduled to
+	// cancel at CurrentPeriodEnd rather than immediately. It's a separate
+	// flag from IsCancelled, which UpdateSubscriptionCancellationStatus and
+	// the immediate cancellation paths set.
+	CancelAtPeriodEnd bool `json:"cancelAtPeriodEnd"`
+	// DiscountID and DiscountEnd surface a discount currently applied to
+	// the Stripe subscription (e.g. a referral credit coupon), if any, so
+	// the client can show "Free until <date>" instead of the plan's usual
+	// price. DiscountEnd is empty/zero if the discount has no end date.
+	DiscountID  string `json:"discountID,omitempty"`
+	DiscountEnd int64  `json:"discountEnd,omitempty"`
+}
@@ -0,0 +1,19 @@
+package ente
+
+// SubscriptionPreviewLineItem is a single prorated charge or credit line
+// from the upcoming invoice preview.
+type SubscriptionPreviewLineItem struct {
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+}
+
+// SubscriptionPreviewResponse is the prorated cost of switching to a new
+// plan, returned by PreviewSubscriptionUpdate before anything is actually
+// charged.
+type SubscriptionPreviewResponse struct {
+	Currency      string                        `json:"currency"`
+	Total         int64                         `json:"total"`
+	NextBillingAt int64                         `json:"nextBillingAt"`
+	ProrationDate int64                         `json:"prorationDate"`
+	LineItems     []SubscriptionPreviewLineItem `json:"lineItems"`
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/controller"
+	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// BillingCancellationHandler exposes the cancel-at-period-end flow as an
+// alternative to the immediate, prorated cancellation already reachable
+// elsewhere.
+type BillingCancellationHandler struct {
+	StripeController *controller.StripeController
+}
+
+type scheduleCancellationRequest struct {
+	AtPeriodEnd bool `json:"atPeriodEnd"`
+}
+
+// ScheduleCancellation handles POST /billing/stripe/schedule-cancellation.
+// Pass atPeriodEnd=false to undo a previously scheduled cancellation.
+func (h *BillingCancellationHandler) ScheduleCancellation(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	var req scheduleCancellationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	subscription, err := h.StripeController.ScheduleCancellationForUser(userID, req.AtPeriodEnd)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// ReactivateSubscription handles POST /billing/stripe/reactivate, clearing a
+// pending cancel-at-period-end before the billing period ends.
+func (h *BillingCancellationHandler) ReactivateSubscription(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	subscription, err := h.StripeController.ReactivateSubscription(userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
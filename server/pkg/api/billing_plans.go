@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/pkg/controller/plancatalog"
+	"github.com/gin-gonic/gin"
+)
+
+// BillingPlansHandler exposes the multi-currency plan catalog.
+type BillingPlansHandler struct {
+	PlanCatalogCtrl *plancatalog.Controller
+}
+
+// GetPlans handles GET /billing/plans?country=XX, returning every catalog
+// entry available for purchase from that Stripe account country.
+func (h *BillingPlansHandler) GetPlans(c *gin.Context) {
+	country := c.Query("country")
+	if country == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "country is required"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"plans": h.PlanCatalogCtrl.ForCountry(ente.StripeAccountCountry(country)),
+	})
+}
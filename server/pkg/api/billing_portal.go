@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/controller"
+	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// BillingPortalHandler exposes the self-serve Stripe Billing Portal and an
+// in-place plan-change endpoint next to it.
+type BillingPortalHandler struct {
+	StripeController *controller.StripeController
+}
+
+// GetPortalSession handles GET /billing/stripe/portal?redirectRootURL=xxx,
+// returning a Stripe Billing Portal session URL the client can redirect to.
+func (h *BillingPortalHandler) GetPortalSession(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	redirectRootURL := c.Query("redirectRootURL")
+	if redirectRootURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirectRootURL is required"})
+		return
+	}
+	url, err := h.StripeController.GetStripeCustomerPortal(userID, redirectRootURL)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": url})
+}
+
+type updateSubscriptionPlanRequest struct {
+	ProductID string `json:"productID" binding:"required"`
+}
+
+// UpdateSubscriptionPlan handles POST /billing/stripe/change-plan, switching
+// the user's existing subscription in-place instead of through the
+// cancel-and-resubscribe flow used by GetCheckoutSession.
+func (h *BillingPortalHandler) UpdateSubscriptionPlan(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	var req updateSubscriptionPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "productID is required"})
+		return
+	}
+	subscription, err := h.StripeController.UpdateSubscriptionPlan(userID, req.ProductID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
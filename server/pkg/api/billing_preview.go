@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/controller"
+	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// BillingPreviewHandler surfaces proration previews to the client so it can
+// show a confirmation dialog before committing a plan change.
+type BillingPreviewHandler struct {
+	StripeController *controller.StripeController
+}
+
+// PreviewSubscriptionUpdate handles GET /billing/stripe/preview-update?productID=xxx
+func (h *BillingPreviewHandler) PreviewSubscriptionUpdate(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	productID := c.Query("productID")
+	if productID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "productID is required"})
+		return
+	}
+	preview, err := h.StripeController.PreviewSubscriptionUpdate(userID, productID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/controller"
+	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// BillingUpdateHandler lets a client commit a plan change after confirming
+// the proration shown by BillingPreviewHandler.PreviewSubscriptionUpdate.
+type BillingUpdateHandler struct {
+	StripeController *controller.StripeController
+}
+
+type updateSubscriptionRequest struct {
+	ProductID     string `json:"productID" binding:"required"`
+	ProrationDate int64  `json:"prorationDate"`
+}
+
+// UpdateSubscription handles POST /billing/stripe/update-subscription.
+// ProrationDate should be the value returned by the preceding call to
+// PreviewSubscriptionUpdate, so that the actual charge matches what the
+// client already confirmed with the user.
+func (h *BillingUpdateHandler) UpdateSubscription(c *gin.Context) {
+	userID := auth.GetUserID(c.Request.Header)
+	var req updateSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "productID is required"})
+		return
+	}
+	response, err := h.StripeController.UpdateSubscription(req.ProductID, userID, req.ProrationDate)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/repo/referral"
+	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// ReferralHandler records who referred whom, so the referrer can later be
+// granted a credit once the referred user's subscription produces its
+// first paid invoice (see StripeController.grantReferralCreditIfApplicable).
+type ReferralHandler struct {
+	ReferralRepo *referral.Repository
+}
+
+type recordReferralRequest struct {
+	ReferrerUserID int64 `json:"referrerUserID" binding:"required"`
+}
+
+// RecordReferral handles POST /referral, called once by a newly signed up
+// user who arrived via another user's referral link.
+func (h *ReferralHandler) RecordReferral(c *gin.Context) {
+	referredUserID := auth.GetUserID(c.Request.Header)
+	var req recordReferralRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "referrerUserID is required"})
+		return
+	}
+	if req.ReferrerUserID == referredUserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot refer yourself"})
+		return
+	}
+	if err := h.ReferralRepo.RecordReferral(referredUserID, req.ReferrerUserID); err != nil {
+		handleError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,26 @@
+package commonbilling
+
+import (
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/stacktrace"
+)
+
+// DowngradeToFreePlan moves a user's subscription down to the free plan,
+// irrespective of which payment provider they're currently on. This is used
+// e.g. by the dunning cron once a past_due subscription has exceeded its
+// grace period.
+func (c *Controller) DowngradeToFreePlan(userID int64) error {
+	subscription, err := c.BillingRepo.GetUserSubscription(userID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	freeSubscription := ente.Subscription{
+		UserID:          userID,
+		Storage:         ente.FreePlanStorage,
+		ProductID:       ente.FreePlanProductID,
+		PaymentProvider: ente.Stripe,
+		ExpiryTime:      subscription.ExpiryTime,
+		Attributes:      ente.SubscriptionAttributes{},
+	}
+	return stacktrace.Propagate(c.BillingRepo.ReplaceSubscription(subscription.ID, freeSubscription), "")
+}
@@ -0,0 +1,197 @@
+// Package dunning implements the delinquency state machine that runs on top
+// of Stripe subscriptions that have entered the `past_due` status.
+//
+// A subscription is tracked from the moment it first goes `past_due` until it
+// either recovers (moves back to `active`) or has been delinquent for long
+// enough that we give up and downgrade the account to the free plan.
+package dunning
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/pkg/controller/commonbilling"
+	"github.com/ente-io/museum/pkg/controller/discord"
+	"github.com/ente-io/museum/pkg/repo"
+	"github.com/ente-io/museum/pkg/utils/email"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Controller drives the past-due -> reminder -> downgrade state machine for
+// Stripe subscriptions.
+type Controller struct {
+	BillingRepo       *repo.BillingRepository
+	UserRepo          *repo.UserRepository
+	StripeClients     ente.StripeClientPerAccount
+	CommonBillCtrl    *commonbilling.Controller
+	DiscordController *discord.DiscordController
+
+	// DunningGraceDays is the number of days a subscription is allowed to
+	// stay `past_due` before it's downgraded to the free plan.
+	DunningGraceDays int
+	// DunningReminderDays are the days (since the subscription first went
+	// past_due) on which we send an escalating reminder email.
+	DunningReminderDays []int
+}
+
+// New returns a new instance of Controller, reading `dunning.grace-days`
+// (default 7) and `dunning.reminder-days` (default 1, 3, 7) from viper, and
+// starts the hourly cron that drives the past-due -> reminder -> downgrade
+// state machine for as long as the process is alive.
+func New(billingRepo *repo.BillingRepository, userRepo *repo.UserRepository, stripeClients ente.StripeClientPerAccount, commonBillCtrl *commonbilling.Controller, discordController *discord.DiscordController) *Controller {
+	graceDays := viper.GetInt("dunning.grace-days")
+	if graceDays <= 0 {
+		graceDays = 7
+	}
+	reminderDays := viper.GetIntSlice("dunning.reminder-days")
+	if len(reminderDays) == 0 {
+		reminderDays = []int{1, 3, 7}
+	}
+	c := &Controller{
+		BillingRepo:         billingRepo,
+		UserRepo:            userRepo,
+		StripeClients:       stripeClients,
+		CommonBillCtrl:      commonBillCtrl,
+		DiscordController:   discordController,
+		DunningGraceDays:    graceDays,
+		DunningReminderDays: reminderDays,
+	}
+	go c.runCronHourly()
+	return c
+}
+
+// runCronHourly calls RunCron once an hour for as long as the process keeps
+// running. RunCron logs (and, for failed downgrades, reports to Discord) the
+// failures of single subscriptions itself; the error it returns, from
+// failing to list the past-due subscriptions, is logged here.
+func (c *Controller) runCronHourly() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.RunCron(context.Background()); err != nil {
+			log.WithError(err).Error("dunning: cron run failed")
+		}
+	}
+}
+
+// TrackPastDue records (or continues tracking) a subscription that has just
+// been reported as `past_due` by Stripe, sending an escalating reminder email
+// if today is one of the configured reminder days.
+func (c *Controller) TrackPastDue(userID int64, email string) error {
+	firstPastDueAt, err := c.BillingRepo.GetOrCreatePastDueSince(userID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	lastReminderDay, err := c.BillingRepo.GetLastReminderDay(userID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	daysPastDue := int(time.Since(firstPastDueAt).Hours() / 24)
+	for _, day := range c.DunningReminderDays {
+		if daysPastDue == day && lastReminderDay < day {
+			if sendErr := c.sendReminderEmail(email, day); sendErr != nil {
+				return stacktrace.Propagate(sendErr, "")
+			}
+			if sendErr := c.BillingRepo.SetLastReminderDay(userID, day); sendErr != nil {
+				return stacktrace.Propagate(sendErr, "")
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// TrackPaymentFailure records (or continues tracking) a subscription after
+// an `invoice.payment_failed` webhook, same as TrackPastDue, additionally
+// remembering the failed invoice so the grace-period cron can void it if
+// the subscription is eventually downgraded.
+func (c *Controller) TrackPaymentFailure(userID int64, userEmail string, invoiceID string) error {
+	if err := c.TrackPastDue(userID, userEmail); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return stacktrace.Propagate(c.BillingRepo.SetPastDueLatestInvoice(userID, invoiceID), "")
+}
+
+// ClearPastDue removes the delinquency tracking for a subscription, called
+// when Stripe reports that the subscription has recovered to `active` (or
+// has been paid via `invoice.paid`).
+func (c *Controller) ClearPastDue(userID int64) error {
+	return stacktrace.Propagate(c.BillingRepo.ClearPastDueSince(userID), "")
+}
+
+func (c *Controller) sendReminderEmail(toEmail string, day int) error {
+	return email.SendTemplatedEmail([]string{toEmail}, "ente", "support@ente.io",
+		ente.PastDueReminderEmailSubject, ente.PastDueReminderEmailTemplate,
+		map[string]interface{}{
+			"Day": day,
+		}, nil)
+}
+
+// RunCron scans every subscription that is currently tracked as past-due and
+// drives it through the rest of the state machine: sending the next
+// escalating reminder email if today is one of the configured reminder days
+// we haven't sent yet, or, once it has been delinquent for longer than the
+// configured grace period, downgrading the account to the free plan. It is
+// meant to be invoked hourly, and is the only place that guarantees a
+// past-due subscription keeps getting nudged even if it never generates
+// another webhook between going past_due and the grace period expiring.
+func (c *Controller) RunCron(ctx context.Context) error {
+	pastDue, err := c.BillingRepo.GetAllPastDueSubscriptions(ctx)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	for _, sub := range pastDue {
+		daysPastDue := int(time.Since(sub.FirstPastDueAt).Hours() / 24)
+		if daysPastDue >= c.DunningGraceDays {
+			if downgradeErr := c.downgrade(sub); downgradeErr != nil {
+				log.WithError(downgradeErr).WithField("userID", sub.UserID).Error("dunning: failed to downgrade past due subscription")
+				c.DiscordController.Notify(fmt.Sprintf("dunning: failed to downgrade past due subscription for userID %d", sub.UserID))
+			}
+			continue
+		}
+		if remindErr := c.sendDueReminder(sub, daysPastDue); remindErr != nil {
+			log.WithError(remindErr).WithField("userID", sub.UserID).Error("dunning: failed to send past due reminder")
+		}
+	}
+	return nil
+}
+
+// sendDueReminder sends the escalating reminder email for sub if
+// daysPastDue has just reached one of DunningReminderDays that we haven't
+// already sent a reminder for.
+func (c *Controller) sendDueReminder(sub ente.PastDueSubscription, daysPastDue int) error {
+	for _, day := range c.DunningReminderDays {
+		if daysPastDue != day || sub.LastReminderDay >= day {
+			continue
+		}
+		user, err := c.UserRepo.Get(sub.UserID)
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+		if err = c.sendReminderEmail(user.Email, day); err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+		return stacktrace.Propagate(c.BillingRepo.SetLastReminderDay(sub.UserID, day), "")
+	}
+	return nil
+}
+
+// downgrade moves the user back to the free plan and voids the outstanding
+// invoice that triggered the delinquency, then stops tracking it.
+func (c *Controller) downgrade(sub ente.PastDueSubscription) error {
+	if err := c.CommonBillCtrl.DowngradeToFreePlan(sub.UserID); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if sub.LatestInvoiceID != "" {
+		stripeClient := c.StripeClients[sub.StripeAccountCountry]
+		if _, err := stripeClient.Invoices.VoidInvoice(sub.LatestInvoiceID, nil); err != nil {
+			log.WithError(err).WithField("userID", sub.UserID).Warn("dunning: failed to void outstanding invoice")
+		}
+	}
+	c.DiscordController.Notify(fmt.Sprintf("dunning: downgraded userID %d to free plan after exceeding grace period", sub.UserID))
+	return stacktrace.Propagate(c.BillingRepo.ClearPastDueSince(sub.UserID), "")
+}
@@ -0,0 +1,176 @@
+// Package plancatalog models the cross-currency price list for ente's
+// subscription plans, sourced lazily from Stripe so that the unit amount
+// and currency we advertise to a client always matches what Stripe will
+// actually charge.
+package plancatalog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/pkg/controller/discord"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Entry is a single purchasable (plan, country, currency) combination.
+type Entry struct {
+	PlanKey       string
+	Country       ente.StripeAccountCountry
+	Currency      string
+	StripePriceID string
+	UnitAmount    int64
+	Storage       int64
+}
+
+// Controller lazily builds and serves the plan catalog.
+type Controller struct {
+	BillingPlansPerAccount ente.BillingPlansPerAccount
+	StripeClients          ente.StripeClientPerAccount
+	DiscordController      *discord.DiscordController
+
+	mu      sync.RWMutex
+	entries []Entry
+}
+
+// refreshInterval is how often Refresh is re-run in the background once the
+// catalog has been populated, so that price/currency changes made on
+// Stripe's side eventually show up without a deploy.
+const refreshInterval = 1 * time.Hour
+
+// New returns a new instance of Controller, does an initial synchronous
+// Refresh so the catalog is populated once New returns, and then keeps it
+// up to date with a background refresh loop. If that initial Refresh fails,
+// the error is logged and the catalog stays empty until a later refresh
+// succeeds.
+func New(plans ente.BillingPlansPerAccount, stripeClients ente.StripeClientPerAccount, discordController *discord.DiscordController) *Controller {
+	c := &Controller{
+		BillingPlansPerAccount: plans,
+		StripeClients:          stripeClients,
+		DiscordController:      discordController,
+	}
+	if err := c.Refresh(); err != nil {
+		log.WithError(err).Error("plancatalog: initial refresh failed")
+	}
+	c.reportMissingPricesFromConfig()
+	go c.refreshPeriodically()
+	return c
+}
+
+// refreshPeriodically re-runs Refresh (and the missing-price reconciliation)
+// on refreshInterval for as long as the process keeps running.
+func (c *Controller) refreshPeriodically() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.Refresh(); err != nil {
+			log.WithError(err).Error("plancatalog: periodic refresh failed")
+			continue
+		}
+		c.reportMissingPricesFromConfig()
+	}
+}
+
+// reportMissingPricesFromConfig runs ReportMissingPrices against the
+// currencies configured in `plancatalog.expected-currencies`. It's a no-op
+// if that's left unset, e.g. in deployments that only ever sell in one
+// currency.
+func (c *Controller) reportMissingPricesFromConfig() {
+	expectedCurrencies := viper.GetStringSlice("plancatalog.expected-currencies")
+	if len(expectedCurrencies) == 0 {
+		return
+	}
+	c.ReportMissingPrices(expectedCurrencies)
+}
+
+// planKey identifies a logical plan (e.g. "50GB monthly") independent of
+// which Stripe price/currency backs it for a given account.
+func planKey(storage int64, period string) string {
+	return fmt.Sprintf("%d_%s", storage, period)
+}
+
+// Refresh fetches the live price/currency for every configured plan from
+// Stripe and rebuilds the in-memory catalog. It's safe to call
+// concurrently with ForCountry/Resolve.
+func (c *Controller) Refresh() error {
+	var entries []Entry
+	for country, plansByPeriod := range c.BillingPlansPerAccount {
+		stripeClient := c.StripeClients[country]
+		for period, plans := range plansByPeriod {
+			for _, plan := range plans {
+				p, err := stripeClient.Prices.Get(plan.StripeID, nil)
+				if err != nil {
+					return stacktrace.Propagate(err, fmt.Sprintf("failed to fetch stripe price %s", plan.StripeID))
+				}
+				entries = append(entries, Entry{
+					PlanKey:       planKey(plan.Storage, period),
+					Country:       country,
+					Currency:      string(p.Currency),
+					StripePriceID: plan.StripeID,
+					UnitAmount:    p.UnitAmount,
+					Storage:       plan.Storage,
+				})
+			}
+		}
+	}
+	c.mu.Lock()
+	c.entries = entries
+	c.mu.Unlock()
+	return nil
+}
+
+// ForCountry returns the catalog entries available for a given account
+// country, used to serve GET /billing/plans?country=XX.
+func (c *Controller) ForCountry(country ente.StripeAccountCountry) []Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var result []Entry
+	for _, e := range c.entries {
+		if e.Country == country {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Resolve looks up the Stripe account country and price ID for a
+// (planKey, currency) pair, so that GetCheckoutSession can route the
+// checkout to the right Stripe account.
+func (c *Controller) Resolve(planKey string, currency string) (ente.StripeAccountCountry, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, e := range c.entries {
+		if e.PlanKey == planKey && e.Currency == currency {
+			return e.Country, e.StripePriceID, nil
+		}
+	}
+	return "", "", stacktrace.Propagate(ente.ErrNotFound, "")
+}
+
+// ReportMissingPrices notifies Discord about any plan that isn't available
+// in every currency we expect to sell in, so pricing gaps get caught before
+// a customer hits them at checkout.
+func (c *Controller) ReportMissingPrices(expectedCurrencies []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	havePlanCurrency := make(map[string]bool)
+	for _, e := range c.entries {
+		havePlanCurrency[e.PlanKey+"|"+e.Currency] = true
+	}
+	seenPlanKeys := make(map[string]bool)
+	for _, e := range c.entries {
+		seenPlanKeys[e.PlanKey] = true
+	}
+	for planKey := range seenPlanKeys {
+		for _, currency := range expectedCurrencies {
+			if !havePlanCurrency[planKey+"|"+currency] {
+				msg := fmt.Sprintf("plan catalog: plan %s has no price in currency %s", planKey, currency)
+				log.Warn(msg)
+				c.DiscordController.Notify(msg)
+			}
+		}
+	}
+}
@@ -9,9 +9,13 @@ import (
 	"github.com/ente-io/museum/pkg/controller/commonbilling"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/ente-io/museum/pkg/controller/discord"
+	"github.com/ente-io/museum/pkg/controller/dunning"
 	"github.com/ente-io/museum/pkg/controller/offer"
+	"github.com/ente-io/museum/pkg/controller/plancatalog"
+	"github.com/ente-io/museum/pkg/repo/referral"
 	"github.com/ente-io/museum/pkg/repo/storagebonus"
 
 	"github.com/ente-io/museum/ente"
@@ -37,10 +41,13 @@ type StripeController struct {
 	FileRepo               *repo.FileRepository
 	UserRepo               *repo.UserRepository
 	StorageBonusRepo       *storagebonus.Repository
+	ReferralRepo           *referral.Repository
 	DiscordController      *discord.DiscordController
 	EmailNotificationCtrl  *emailCtrl.EmailNotificationController
 	OfferController        *offer.OfferController
 	CommonBillCtrl         *commonbilling.Controller
+	DunningCtrl            *dunning.Controller
+	PlanCatalogCtrl        *plancatalog.Controller
 }
 
 // A flag we set on Stripe subscriptions to indicate that we should skip on
@@ -51,23 +58,97 @@ type StripeController struct {
 const SkipMailKey = "skip_mail"
 
 // Return a new instance of StripeController
-func NewStripeController(plans ente.BillingPlansPerAccount, stripeClients ente.StripeClientPerAccount, billingRepo *repo.BillingRepository, fileRepo *repo.FileRepository, userRepo *repo.UserRepository, storageBonusRepo *storagebonus.Repository, discordController *discord.DiscordController, emailNotificationController *emailCtrl.EmailNotificationController, offerController *offer.OfferController, commonBillCtrl *commonbilling.Controller) *StripeController {
-	return &StripeController{
+func NewStripeController(plans ente.BillingPlansPerAccount, stripeClients ente.StripeClientPerAccount, billingRepo *repo.BillingRepository, fileRepo *repo.FileRepository, userRepo *repo.UserRepository, storageBonusRepo *storagebonus.Repository, referralRepo *referral.Repository, discordController *discord.DiscordController, emailNotificationController *emailCtrl.EmailNotificationController, offerController *offer.OfferController, commonBillCtrl *commonbilling.Controller) *StripeController {
+	c := &StripeController{
 		StripeClients:          stripeClients,
 		BillingRepo:            billingRepo,
 		FileRepo:               fileRepo,
 		UserRepo:               userRepo,
 		BillingPlansPerAccount: plans,
 		StorageBonusRepo:       storageBonusRepo,
+		ReferralRepo:           referralRepo,
 		DiscordController:      discordController,
 		EmailNotificationCtrl:  emailNotificationController,
 		OfferController:        offerController,
 		CommonBillCtrl:         commonBillCtrl,
+		DunningCtrl:            dunning.New(billingRepo, userRepo, stripeClients, commonBillCtrl, discordController),
+		PlanCatalogCtrl:        plancatalog.New(plans, stripeClients, discordController),
 	}
+	go c.bootstrapBillingPortal()
+	go c.purgeOldStripeEventsPeriodically()
+	return c
+}
+
+// bootstrapBillingPortal publishes our Billing Portal configuration on
+// startup so that GetStripeCustomerPortal/CreateBillingPortalSession can use
+// it instead of the account's default portal; if publishing fails for an
+// account, sessions for that account are created without a configuration
+// and get Stripe's default portal. It's run in the
+// background because it makes a handful of Stripe API calls per account and
+// shouldn't delay the rest of startup.
+func (c *StripeController) bootstrapBillingPortal() {
+	if err := c.ConfigureCustomerPortal(); err != nil {
+		log.WithError(err).Error("failed to configure billing portal on startup")
+	}
+}
+
+// purgeOldStripeEventsPeriodically calls PurgeOldStripeEvents once a day for
+// as long as the process keeps running, so the stripe_events dedupe table
+// (which now also stores the full raw event payload, see
+// PurgeOldStripeEvents) doesn't grow unboundedly forever. Events are kept
+// for `stripe.events.retention-days` (default 90) before being purged.
+func (c *StripeController) purgeOldStripeEventsPeriodically() {
+	retentionDays := viper.GetInt("stripe.events.retention-days")
+	if retentionDays <= 0 {
+		retentionDays = 90
+	}
+	retention := time.Duration(retentionDays) * 24 * time.Hour
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := c.BillingRepo.PurgeOldStripeEvents(retention); err != nil {
+			log.WithError(err).Error("failed to purge old stripe events")
+		}
+		<-ticker.C
+	}
+}
+
+// GetCheckoutSessionForPlan is the currency-aware counterpart of
+// GetCheckoutSession: instead of a Stripe price ID (which is tied to a
+// single currency and Stripe account), it accepts a logical planKey plus
+// the currency the customer wants to be billed in, resolves that to the
+// right Stripe account + price via the plan catalog, and routes the
+// checkout there.
+func (c *StripeController) GetCheckoutSessionForPlan(planKey string, currency string, userID int64, redirectRootURL string) (string, error) {
+	stripeAccountCountry, stripePriceID, err := c.PlanCatalogCtrl.Resolve(planKey, currency)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "")
+	}
+	return c.createCheckoutSession(stripePriceID, userID, redirectRootURL, "", stripeAccountCountry)
 }
 
 // GetCheckoutSession handles the creation of stripe checkout session for subscription purchase
 func (c *StripeController) GetCheckoutSession(productID string, userID int64, redirectRootURL string) (string, error) {
+	return c.createCheckoutSession(productID, userID, redirectRootURL, "", ente.DefaultStripeAccountCountry)
+}
+
+// CreateCheckoutSessionWithPromoCode is a variant of GetCheckoutSession for
+// flows where the discount to apply is already known server-side (e.g. a
+// one-off coupon minted for a referral credit) rather than typed in by the
+// customer on Stripe's hosted checkout page.
+func (c *StripeController) CreateCheckoutSessionWithPromoCode(productID string, userID int64, redirectRootURL string, promoCode string) (string, error) {
+	if promoCode == "" {
+		return "", stacktrace.Propagate(ente.ErrBadRequest, "")
+	}
+	return c.createCheckoutSession(productID, userID, redirectRootURL, promoCode, ente.DefaultStripeAccountCountry)
+}
+
+// createCheckoutSession creates the Stripe checkout session for productID
+// against newSubscriberAccountCountry's Stripe account, unless userID
+// already has a Stripe subscription on record -- in which case we must
+// stick to the account that subscription (and its customer ID) actually
+// lives on, regardless of what the caller asked for.
+func (c *StripeController) createCheckoutSession(productID string, userID int64, redirectRootURL string, promoCode string, newSubscriberAccountCountry ente.StripeAccountCountry) (string, error) {
 	if productID == "" {
 		return "", stacktrace.Propagate(ente.ErrBadRequest, "")
 	}
@@ -94,7 +175,6 @@ func (c *StripeController) GetCheckoutSession(productID string, userID int64, re
 	}
 	stripeSuccessURL := redirectRootURL + viper.GetString("stripe.path.success")
 	stripeCancelURL := redirectRootURL + viper.GetString("stripe.path.cancel")
-	allowPromotionCodes := true
 	params := &stripe.CheckoutSessionParams{
 		ClientReferenceID: stripe.String(strconv.FormatInt(userID, 10)),
 		SuccessURL:        stripe.String(stripeSuccessURL),
@@ -106,7 +186,15 @@ func (c *StripeController) GetCheckoutSession(productID string, userID int64, re
 				Quantity: stripe.Int64(1),
 			},
 		},
-		AllowPromotionCodes: &allowPromotionCodes,
+	}
+	if promoCode != "" {
+		// Discounts and AllowPromotionCodes are mutually exclusive on the
+		// Stripe API; since we already know which coupon to apply, there's
+		// no need to also let the customer type one in.
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{{Coupon: stripe.String(promoCode)}}
+	} else {
+		allowPromotionCodes := true
+		params.AllowPromotionCodes = &allowPromotionCodes
 	}
 	var stripeClient *client.API
 	if subscription.PaymentProvider == ente.Stripe {
@@ -114,7 +202,7 @@ func (c *StripeController) GetCheckoutSession(productID string, userID int64, re
 		// attach the subscription to existing customerID
 		params.Customer = stripe.String(subscription.Attributes.CustomerID)
 	} else {
-		stripeClient = c.StripeClients[ente.DefaultStripeAccountCountry]
+		stripeClient = c.StripeClients[newSubscriberAccountCountry]
 		user, err := c.UserRepo.Get(userID)
 		if err != nil {
 			return "", stacktrace.Propagate(err, "")
@@ -133,21 +221,22 @@ func (c *StripeController) GetCheckoutSession(productID string, userID int64, re
 // GetVerifiedSubscription verifies and returns the verified subscription
 func (c *StripeController) GetVerifiedSubscription(userID int64, sessionID string) (ente.Subscription, error) {
 	var stripeSubscription stripe.Subscription
+	var accountCountry ente.StripeAccountCountry
 	var err error
 	if sessionID != "" {
 		log.Info("Received session ID: " + sessionID)
 		// Get verified subscription request was received from success redirect page
-		stripeSubscription, err = c.getStripeSubscriptionFromSession(userID, sessionID)
+		stripeSubscription, accountCountry, err = c.getStripeSubscriptionFromSession(userID, sessionID)
 	} else {
 		log.Info("Did not receive a session ID")
 		// Get verified subscription request for a subscription update
-		stripeSubscription, err = c.getUserStripeSubscription(userID)
+		stripeSubscription, accountCountry, err = c.getUserStripeSubscription(userID)
 	}
 	if err != nil {
 		return ente.Subscription{}, stacktrace.Propagate(err, "")
 	}
 	log.Info("Received stripe subscription with ID: " + stripeSubscription.ID)
-	subscription, err := c.getEnteSubscriptionFromStripeSubscription(userID, stripeSubscription)
+	subscription, err := c.getEnteSubscriptionFromStripeSubscription(userID, accountCountry, stripeSubscription)
 	if err != nil {
 		return ente.Subscription{}, stacktrace.Propagate(err, "")
 	}
@@ -172,6 +261,18 @@ func (c *StripeController) HandleINNotification(payload []byte, header string) e
 }
 
 func (c *StripeController) handleWebhookEvent(event stripe.Event) error {
+	// Stripe guarantees at-least-once delivery, and will happily retry the
+	// same event multiple times (e.g. if we're slow to ack). Claim the event
+	// by ID first so that retries of an event we've already processed are a
+	// guaranteed no-op, instead of racing the original handler.
+	claimed, err := c.BillingRepo.TryClaimEvent(event.ID, string(event.Type), time.Unix(event.Created, 0), event.Data.Raw)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if !claimed {
+		log.Info("Ignoring already processed stripe webhook event:", event.ID)
+		return nil
+	}
 	// The event body would already have been logged by the upper layers by the
 	// time we get here, so we can only handle the events that we care about. In
 	// case we receive an unexpected event, we do log an error though.
@@ -182,6 +283,18 @@ func (c *StripeController) handleWebhookEvent(event stripe.Event) error {
 	}
 	eventLog, err := handler(event)
 	if err != nil {
+		// The claim was persisted before the handler ran so that concurrent
+		// deliveries of the same event can't race each other, but that
+		// means a failed handler has to release it again: otherwise
+		// Stripe's retry of this exact event -- the only reason retries
+		// exist -- would see it as already claimed and silently drop it
+		// forever, without its side effects ever having been applied.
+		if unclaimErr := c.BillingRepo.UnclaimEvent(event.ID); unclaimErr != nil {
+			log.WithError(unclaimErr).Error("Failed to release claim on failed stripe webhook event:", event.ID)
+		}
+		return stacktrace.Propagate(err, "")
+	}
+	if err = c.BillingRepo.MarkEventProcessed(event.ID); err != nil {
 		return stacktrace.Propagate(err, "")
 	}
 	if eventLog.UserID == 0 {
@@ -196,6 +309,66 @@ func (c *StripeController) handleWebhookEvent(event stripe.Event) error {
 	return stacktrace.Propagate(err, "")
 }
 
+// parkedEventEnvelope is the subset of a stripe.Event that we need in order
+// to replay it later, serialized verbatim into stripe_pending_events.
+type parkedEventEnvelope struct {
+	Type    stripe.EventType `json:"type"`
+	Created int64            `json:"created"`
+	Data    json.RawMessage  `json:"data"`
+}
+
+// parkEvent stashes a webhook event whose Stripe subscription we don't know
+// about yet, so that it can be replayed once the subscription is created by
+// a subsequent "checkout.session.completed" event.
+func (c *StripeController) parkEvent(stripeSubscriptionID string, event stripe.Event) {
+	payload, err := json.Marshal(parkedEventEnvelope{Type: event.Type, Created: event.Created, Data: event.Data.Raw})
+	if err != nil {
+		log.WithError(err).Error("Failed to serialize out-of-order stripe webhook event for stripeSubscriptionID:", stripeSubscriptionID)
+		return
+	}
+	if err = c.BillingRepo.ParkPendingEvent(stripeSubscriptionID, event.ID, payload); err != nil {
+		log.WithError(err).Error("Failed to park out-of-order stripe webhook event for stripeSubscriptionID:", stripeSubscriptionID)
+	}
+}
+
+// ReplayParkedEvents re-runs every webhook event parked against
+// stripeSubscriptionID. It's exported for use by the replay-stripe-events
+// CLI, for subscriptions that need a manual nudge.
+func (c *StripeController) ReplayParkedEvents(stripeSubscriptionID string) error {
+	return stacktrace.Propagate(c.drainParkedEvents(stripeSubscriptionID), "")
+}
+
+// drainParkedEvents replays, in order, every webhook event that was parked
+// against stripeSubscriptionID while we didn't yet know about it. If one of
+// them fails to replay, it and every event after it are parked again, so a
+// later replay can pick them up.
+func (c *StripeController) drainParkedEvents(stripeSubscriptionID string) error {
+	pending, err := c.BillingRepo.DrainPendingEvents(stripeSubscriptionID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	for i, p := range pending {
+		var envelope parkedEventEnvelope
+		if err = json.Unmarshal(p.Payload, &envelope); err == nil {
+			parkedEvent := stripe.Event{ID: p.EventID, Type: envelope.Type, Created: envelope.Created, Data: &stripe.EventData{Raw: envelope.Data}}
+			handler := c.findHandlerForEvent(parkedEvent)
+			if handler == nil {
+				continue
+			}
+			_, err = handler(parkedEvent)
+		}
+		if err != nil {
+			for _, rest := range pending[i:] {
+				if parkErr := c.BillingRepo.ParkPendingEvent(stripeSubscriptionID, rest.EventID, rest.Payload); parkErr != nil {
+					log.WithError(parkErr).Error("Failed to re-park stripe webhook event:", rest.EventID)
+				}
+			}
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	return nil
+}
+
 func (c *StripeController) findHandlerForEvent(event stripe.Event) func(event stripe.Event) (ente.StripeEventLog, error) {
 	switch event.Type {
 	case "checkout.session.completed":
@@ -206,6 +379,8 @@ func (c *StripeController) findHandlerForEvent(event stripe.Event) func(event st
 		return c.handleCustomerSubscriptionUpdated
 	case "invoice.paid":
 		return c.handleInvoicePaid
+	case "invoice.payment_failed":
+		return c.handleInvoicePaymentFailed
 	default:
 		return nil
 	}
@@ -222,7 +397,7 @@ func (c *StripeController) handleCheckoutSessionCompleted(event stripe.Event) (e
 		if err != nil {
 			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 		}
-		stripeSubscription, err := c.getStripeSubscriptionFromSession(userID, session.ID)
+		stripeSubscription, _, err := c.getStripeSubscriptionFromSession(userID, session.ID)
 		if err != nil {
 			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 		}
@@ -253,6 +428,13 @@ func (c *StripeController) handleCheckoutSessionCompleted(event stripe.Event) (e
 		if err != nil {
 			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 		}
+		// Now that the subscription row exists, replay any webhook events
+		// (e.g. a "customer.subscription.updated" reporting a plan change
+		// made right after checkout) that arrived before we could process
+		// them.
+		if err = c.drainParkedEvents(stripeSubscription.ID); err != nil {
+			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+		}
 		return ente.StripeEventLog{UserID: userID, StripeSubscription: stripeSubscription, Event: event}, nil
 	} else {
 		priceID, err := c.getPriceIDFromSession(session.ID)
@@ -287,6 +469,17 @@ func (c *StripeController) handleCustomerSubscriptionDeleted(event stripe.Event)
 		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 	}
 	userID := currentSubscription.UserID
+	isDeletedAccount, err := c.BillingRepo.IsAccountDeletionTombstoned(userID)
+	if err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	if isDeletedAccount {
+		// OnAccountDeleted already cancelled the Stripe subscription and
+		// deleted the customer synchronously as part of account deletion;
+		// this is just Stripe's webhook catching up, so there's no user
+		// left to email.
+		return ente.StripeEventLog{UserID: userID, StripeSubscription: stripeSubscription, Event: event}, nil
+	}
 	user, err := c.UserRepo.Get(userID)
 	if err != nil {
 		if errors.Is(err, ente.ErrUserDeleted) {
@@ -330,10 +523,19 @@ func (c *StripeController) handleCustomerSubscriptionUpdated(event stripe.Event)
 		if errors.Is(err, sql.ErrNoRows) {
 			// See: Ignore webhooks received before user has been created
 			log.Warn("Webhook is reporting an event for un-verified subscription stripeSubscriptionID:", stripeSubscription.ID)
+			c.parkEvent(stripeSubscription.ID, event)
 			return ente.StripeEventLog{}, nil
 		}
 		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 	}
+	stale, err := c.BillingRepo.IsStaleEvent(stripeSubscription.ID, time.Unix(event.Created, 0))
+	if err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	if stale {
+		log.Warn("Ignoring out-of-order stripe webhook event for stripeSubscriptionID:", stripeSubscription.ID)
+		return ente.StripeEventLog{UserID: currentSubscription.UserID, StripeSubscription: stripeSubscription, Event: event}, nil
+	}
 
 	userID := currentSubscription.UserID
 	switch stripeSubscription.Status {
@@ -349,8 +551,30 @@ func (c *StripeController) handleCustomerSubscriptionUpdated(event stripe.Event)
 		if err != nil {
 			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 		}
+		// Start (or continue) tracking the delinquency so that the dunning
+		// cron can send escalating reminders and eventually downgrade the
+		// account if it's never cured.
+		if err = c.DunningCtrl.TrackPastDue(userID, user.Email); err != nil {
+			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+		}
 	case stripe.SubscriptionStatusActive:
-		newSubscription, err := c.getEnteSubscriptionFromStripeSubscription(userID, stripeSubscription)
+		// The subscription may be recovering from a past_due state; stop
+		// tracking it for dunning purposes either way.
+		if err := c.DunningCtrl.ClearPastDue(userID); err != nil {
+			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+		}
+		// The customer may have swapped plans or toggled cancel-at-period-end
+		// from the self-serve Billing Portal rather than through our own
+		// API, so reconcile our view of the cancel-at-period-end flag here
+		// too. Note this is a separate flag from Attributes.IsCancelled,
+		// which UpdateSubscriptionCancellationStatus and the immediate
+		// cancellation paths set.
+		if stripeSubscription.CancelAtPeriodEnd != currentSubscription.Attributes.CancelAtPeriodEnd {
+			if err := c.BillingRepo.UpdateSubscriptionCancelAtPeriodEnd(userID, stripeSubscription.CancelAtPeriodEnd); err != nil {
+				return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+			}
+		}
+		newSubscription, err := c.getEnteSubscriptionFromStripeSubscription(userID, currentSubscription.Attributes.StripeAccountCountry, stripeSubscription)
 		if err != nil {
 			return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 		}
@@ -364,6 +588,9 @@ func (c *StripeController) handleCustomerSubscriptionUpdated(event stripe.Event)
 			c.BillingRepo.ReplaceSubscription(currentSubscription.ID, newSubscription)
 		}
 	}
+	if err := c.BillingRepo.MarkEventApplied(stripeSubscription.ID, time.Unix(event.Created, 0)); err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
 	return ente.StripeEventLog{UserID: userID, StripeSubscription: stripeSubscription, Event: event}, nil
 }
 
@@ -377,12 +604,33 @@ func (c *StripeController) handleInvoicePaid(event stripe.Event) (ente.StripeEve
 		if errors.Is(err, sql.ErrNoRows) {
 			// See: Ignore webhooks received before user has been created
 			log.Warn("Webhook is reporting an event for un-verified subscription stripeSubscriptionID:", stripeSubscriptionID)
+			c.parkEvent(stripeSubscriptionID, event)
 			return ente.StripeEventLog{}, nil
 		}
 		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 	}
+	stale, err := c.BillingRepo.IsStaleEvent(stripeSubscriptionID, time.Unix(event.Created, 0))
+	if err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	if stale {
+		log.Warn("Ignoring out-of-order stripe webhook event for stripeSubscriptionID:", stripeSubscriptionID)
+		return ente.StripeEventLog{UserID: currentSubscription.UserID, Event: event}, nil
+	}
 
 	userID := currentSubscription.UserID
+	// A paid invoice means the subscription has recovered, if it was ever
+	// being tracked as delinquent.
+	if err := c.DunningCtrl.ClearPastDue(userID); err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	if invoice.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		// This is the subscription's first paid invoice; grant the
+		// referrer their credit, if userID was referred by someone.
+		if err := c.grantReferralCreditIfApplicable(userID); err != nil {
+			log.WithError(err).WithField("userID", userID).Error("referral: failed to grant credit")
+		}
+	}
 	client := c.StripeClients[currentSubscription.Attributes.StripeAccountCountry]
 
 	stripeSubscription, err := client.Subscriptions.Get(stripeSubscriptionID, nil)
@@ -401,10 +649,130 @@ func (c *StripeController) handleInvoicePaid(event stripe.Event) (ente.StripeEve
 	if err != nil {
 		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
 	}
+	if err = c.BillingRepo.MarkEventApplied(stripeSubscriptionID, time.Unix(event.Created, 0)); err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
 	return ente.StripeEventLog{UserID: userID, StripeSubscription: *stripeSubscription, Event: event}, nil
 }
 
-func (c *StripeController) UpdateSubscription(stripeID string, userID int64) (ente.SubscriptionUpdateResponse, error) {
+// grantReferralCreditIfApplicable mints a one-off Stripe coupon and applies
+// it to referredUserID's referrer, if one is on record and hasn't already
+// been credited. It's called when referredUserID's subscription produces
+// its first paid invoice.
+func (c *StripeController) grantReferralCreditIfApplicable(referredUserID int64) error {
+	referrerUserID, found, err := c.ReferralRepo.GetUngrantedReferrerID(referredUserID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if !found {
+		return nil
+	}
+	referrerSubscription, err := c.BillingRepo.GetUserSubscription(referrerUserID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if referrerSubscription.PaymentProvider != ente.Stripe {
+		// Nothing to apply the coupon to; the referrer isn't (yet) a Stripe
+		// customer.
+		return nil
+	}
+	stripeClient := c.StripeClients[referrerSubscription.Attributes.StripeAccountCountry]
+	percentOff := float64(100)
+	coupon, err := stripeClient.Coupons.New(&stripe.CouponParams{
+		PercentOff: &percentOff,
+		Duration:   stripe.String(string(stripe.CouponDurationOnce)),
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	_, err = stripeClient.Subscriptions.Update(referrerSubscription.OriginalTransactionID, &stripe.SubscriptionParams{
+		Discounts: []*stripe.SubscriptionDiscountParams{{Coupon: stripe.String(coupon.ID)}},
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return stacktrace.Propagate(c.ReferralRepo.MarkCreditGranted(referredUserID, coupon.ID), "")
+}
+
+// Occurs whenever an invoice payment attempt fails, e.g. an expired card.
+// This is the earliest signal we get that a subscription is headed for
+// past_due, so we start the dunning clock right away instead of waiting
+// for a subsequent "customer.subscription.updated".
+func (c *StripeController) handleInvoicePaymentFailed(event stripe.Event) (ente.StripeEventLog, error) {
+	var failedInvoice stripe.Invoice
+	json.Unmarshal(event.Data.Raw, &failedInvoice)
+	stripeSubscriptionID := failedInvoice.Subscription.ID
+	currentSubscription, err := c.BillingRepo.GetSubscriptionForTransaction(stripeSubscriptionID, ente.Stripe)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Warn("Webhook is reporting an event for un-verified subscription stripeSubscriptionID:", stripeSubscriptionID)
+			c.parkEvent(stripeSubscriptionID, event)
+			return ente.StripeEventLog{}, nil
+		}
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	userID := currentSubscription.UserID
+	user, err := c.UserRepo.Get(userID)
+	if err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	if err = c.DunningCtrl.TrackPaymentFailure(userID, user.Email, failedInvoice.ID); err != nil {
+		return ente.StripeEventLog{}, stacktrace.Propagate(err, "")
+	}
+	return ente.StripeEventLog{UserID: userID, Event: event}, nil
+}
+
+// PreviewSubscriptionUpdate returns the prorated charge/credit that would
+// result from switching the user's subscription to newStripeID, without
+// mutating anything. The returned ProrationDate must be passed back into
+// UpdateSubscription so that the actual charge matches this preview exactly
+// (Stripe prorates based on the proration date, which otherwise defaults to
+// "now" and would drift between the preview and the real update).
+func (c *StripeController) PreviewSubscriptionUpdate(userID int64, newStripeID string) (ente.SubscriptionPreviewResponse, error) {
+	subscription, err := c.BillingRepo.GetUserSubscription(userID)
+	if err != nil {
+		return ente.SubscriptionPreviewResponse{}, stacktrace.Propagate(err, "")
+	}
+	if subscription.PaymentProvider != ente.Stripe {
+		return ente.SubscriptionPreviewResponse{}, stacktrace.Propagate(ente.ErrBadRequest, "")
+	}
+	client := c.StripeClients[subscription.Attributes.StripeAccountCountry]
+	stripeSubscription, err := client.Subscriptions.Get(subscription.OriginalTransactionID, nil)
+	if err != nil {
+		return ente.SubscriptionPreviewResponse{}, stacktrace.Propagate(err, "")
+	}
+	prorationDate := time.Now().Unix()
+	params := &stripe.InvoiceUpcomingParams{
+		Customer:                  stripe.String(subscription.Attributes.CustomerID),
+		Subscription:              stripe.String(subscription.OriginalTransactionID),
+		SubscriptionProrationDate: stripe.Int64(prorationDate),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(stripeSubscription.Items.Data[0].ID),
+				Price: stripe.String(newStripeID),
+			},
+		},
+	}
+	upcoming, err := invoice.GetNext(params)
+	if err != nil {
+		return ente.SubscriptionPreviewResponse{}, stacktrace.Propagate(err, "")
+	}
+	response := ente.SubscriptionPreviewResponse{
+		Currency:      string(upcoming.Currency),
+		Total:         upcoming.Total,
+		NextBillingAt: upcoming.NextPaymentAttempt * 1000 * 1000,
+		ProrationDate: prorationDate,
+	}
+	for _, line := range upcoming.Lines.Data {
+		response.LineItems = append(response.LineItems, ente.SubscriptionPreviewLineItem{
+			Description: line.Description,
+			Amount:      line.Amount,
+		})
+	}
+	return response, nil
+}
+
+func (c *StripeController) UpdateSubscription(stripeID string, userID int64, prorationDate int64) (ente.SubscriptionUpdateResponse, error) {
 	subscription, err := c.BillingRepo.GetUserSubscription(userID)
 	if err != nil {
 		return ente.SubscriptionUpdateResponse{}, stacktrace.Propagate(err, "")
@@ -442,6 +810,12 @@ func (c *StripeController) UpdateSubscription(stripeID string, userID int64) (en
 		},
 		PaymentBehavior: stripe.String(string(stripe.SubscriptionPaymentBehaviorPendingIfIncomplete)),
 	}
+	if prorationDate > 0 {
+		// Match the charge the user was already shown by
+		// PreviewSubscriptionUpdate instead of letting Stripe prorate as of
+		// now, which could differ if any time has passed since the preview.
+		params.ProrationDate = stripe.Int64(prorationDate)
+	}
 	params.AddExpand("latest_invoice.payment_intent")
 	newStripeSubscription, err := client.Subscriptions.Update(subscription.OriginalTransactionID, &params)
 	if err != nil {
@@ -468,6 +842,50 @@ func (c *StripeController) UpdateSubscription(stripeID string, userID int64) (en
 
 }
 
+// UpdateSubscriptionPlan switches a user's existing Stripe subscription to
+// newStripeID in-place, reusing the same OriginalTransactionID instead of
+// the cancel-and-resubscribe pattern used elsewhere, so the change produces
+// a single prorated invoice on the existing subscription. It backs our own
+// change-plan API; plan changes made inside the Billing Portal go straight
+// to Stripe and reach us as "customer.subscription.updated" instead. Callers
+// that need to surface `requires_action`/`requires_payment_method` to the
+// client should use UpdateSubscription instead.
+func (c *StripeController) UpdateSubscriptionPlan(userID int64, newStripeID string) (ente.Subscription, error) {
+	subscription, err := c.BillingRepo.GetUserSubscription(userID)
+	if err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	if subscription.PaymentProvider != ente.Stripe {
+		return ente.Subscription{}, stacktrace.Propagate(ente.ErrBadRequest, "")
+	}
+	client := c.StripeClients[subscription.Attributes.StripeAccountCountry]
+	stripeSubscription, err := client.Subscriptions.Get(subscription.OriginalTransactionID, nil)
+	if err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	params := &stripe.SubscriptionParams{
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(stripeSubscription.Items.Data[0].ID),
+				Price: stripe.String(newStripeID),
+			},
+		},
+	}
+	updatedStripeSubscription, err := client.Subscriptions.Update(subscription.OriginalTransactionID, params)
+	if err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	newSubscription, err := c.getEnteSubscriptionFromStripeSubscription(userID, subscription.Attributes.StripeAccountCountry, *updatedStripeSubscription)
+	if err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	if err = c.BillingRepo.ReplaceSubscription(subscription.ID, newSubscription); err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	return newSubscription, nil
+}
+
 func (c *StripeController) UpdateSubscriptionCancellationStatus(userID int64, status bool) (ente.Subscription, error) {
 	subscription, err := c.BillingRepo.GetUserSubscription(userID)
 	if err != nil {
@@ -499,11 +917,64 @@ func (c *StripeController) UpdateSubscriptionCancellationStatus(userID int64, st
 	return subscription, nil
 }
 
+// ScheduleCancellation lets a user choose to cancel at the end of their
+// current billing period rather than immediately: the subscription stays
+// active (and Attributes.IsCancelled stays false) until CurrentPeriodEnd,
+// with Attributes.CancelAtPeriodEnd flipped so the client can display the
+// pending cancellation. Pass atPeriodEnd=false to undo a previously
+// scheduled cancellation while there's still time before the period ends.
+func (c *StripeController) ScheduleCancellation(subscription ente.Subscription, atPeriodEnd bool) error {
+	if subscription.PaymentProvider != ente.Stripe {
+		return stacktrace.Propagate(ente.ErrBadRequest, "")
+	}
+	if subscription.Attributes.CancelAtPeriodEnd == atPeriodEnd {
+		// no-op
+		return nil
+	}
+	client := c.StripeClients[subscription.Attributes.StripeAccountCountry]
+	_, err := client.Subscriptions.Update(subscription.OriginalTransactionID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(atPeriodEnd),
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return stacktrace.Propagate(c.BillingRepo.UpdateSubscriptionCancelAtPeriodEnd(subscription.UserID, atPeriodEnd), "")
+}
+
+// ScheduleCancellationForUser is the userID-keyed counterpart of
+// ScheduleCancellation, for callers (e.g. API handlers) that don't already
+// have the subscription loaded.
+func (c *StripeController) ScheduleCancellationForUser(userID int64, atPeriodEnd bool) (ente.Subscription, error) {
+	subscription, err := c.BillingRepo.GetUserSubscription(userID)
+	if err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	if err = c.ScheduleCancellation(subscription, atPeriodEnd); err != nil {
+		return ente.Subscription{}, stacktrace.Propagate(err, "")
+	}
+	subscription.Attributes.CancelAtPeriodEnd = atPeriodEnd
+	return subscription, nil
+}
+
+// ReactivateSubscription clears a pending cancel-at-period-end before the
+// billing period ends, keeping the subscription running uninterrupted.
+func (c *StripeController) ReactivateSubscription(userID int64) (ente.Subscription, error) {
+	return c.ScheduleCancellationForUser(userID, false)
+}
+
 func (c *StripeController) GetStripeCustomerPortal(userID int64, redirectRootURL string) (string, error) {
 	subscription, err := c.BillingRepo.GetUserSubscription(userID)
 	if err != nil {
 		return "", stacktrace.Propagate(err, "")
 	}
+	return c.CreateBillingPortalSession(subscription, redirectRootURL)
+}
+
+// CreateBillingPortalSession mints a Stripe Billing Portal session URL for
+// an already-resolved subscription, using the country-appropriate Stripe
+// account and our published portal configuration (see
+// ConfigureCustomerPortal) if one has been set up for that account.
+func (c *StripeController) CreateBillingPortalSession(subscription ente.Subscription, redirectRootURL string) (string, error) {
 	if subscription.PaymentProvider != ente.Stripe {
 		return "", stacktrace.Propagate(ente.ErrBadRequest, "")
 	}
@@ -513,6 +984,13 @@ func (c *StripeController) GetStripeCustomerPortal(userID int64, redirectRootURL
 		Customer:  stripe.String(subscription.Attributes.CustomerID),
 		ReturnURL: stripe.String(redirectRootURL),
 	}
+	configurationID, err := c.BillingRepo.GetPortalConfigurationID(string(subscription.Attributes.StripeAccountCountry))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", stacktrace.Propagate(err, "")
+	}
+	if configurationID != "" {
+		params.Configuration = stripe.String(configurationID)
+	}
 	ps, err := client.BillingPortalSessions.New(params)
 	if err != nil {
 		return "", stacktrace.Propagate(err, "")
@@ -520,27 +998,95 @@ func (c *StripeController) GetStripeCustomerPortal(userID int64, redirectRootURL
 	return ps.URL, nil
 }
 
-func (c *StripeController) getStripeSubscriptionFromSession(userID int64, checkoutSessionID string) (stripe.Subscription, error) {
+// ConfigureCustomerPortal publishes an ente-branded Billing Portal
+// configuration for every Stripe account we operate, listing all of our
+// plans as allowed products and enabling self-serve plan switching and
+// cancel-at-period-end. It's run from every process start (see
+// bootstrapBillingPortal), but skips accounts that already have a
+// configuration on record: otherwise every boot of every replica would mint
+// a fresh Billing Portal Configuration object and race to overwrite the DB
+// row with whichever finished last. The resulting configuration ID is
+// persisted per account country and reused by GetStripeCustomerPortal.
+func (c *StripeController) ConfigureCustomerPortal() error {
+	for accountCountry, stripeClient := range c.StripeClients {
+		existingConfigurationID, err := c.BillingRepo.GetPortalConfigurationID(string(accountCountry))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return stacktrace.Propagate(err, "")
+		}
+		if existingConfigurationID != "" {
+			continue
+		}
+		// plan.StripeID is a price ID; the portal wants each product once,
+		// with the prices of it that we sell.
+		pricesByProduct := make(map[string][]*string)
+		for _, plans := range c.BillingPlansPerAccount[accountCountry] {
+			for _, plan := range plans {
+				price, err := stripeClient.Prices.Get(plan.StripeID, nil)
+				if err != nil {
+					return stacktrace.Propagate(err, fmt.Sprintf("failed to fetch stripe price %s", plan.StripeID))
+				}
+				pricesByProduct[price.Product.ID] = append(pricesByProduct[price.Product.ID], stripe.String(plan.StripeID))
+			}
+		}
+		var products []*stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams
+		for productID, prices := range pricesByProduct {
+			products = append(products, &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams{
+				Product: stripe.String(productID),
+				Prices:  prices,
+			})
+		}
+		params := &stripe.BillingPortalConfigurationParams{
+			BusinessProfile: &stripe.BillingPortalConfigurationBusinessProfileParams{
+				PrivacyPolicyURL:  stripe.String(viper.GetString("stripe.portal.privacy-url")),
+				TermsOfServiceURL: stripe.String(viper.GetString("stripe.portal.tos-url")),
+			},
+			Features: &stripe.BillingPortalConfigurationFeaturesParams{
+				SubscriptionUpdate: &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateParams{
+					Enabled:               stripe.Bool(true),
+					DefaultAllowedUpdates: stripe.StringSlice([]string{"price"}),
+					ProrationBehavior:     stripe.String(string(stripe.SubscriptionProrationBehaviorAlwaysInvoice)),
+					Products:              products,
+				},
+				SubscriptionCancel: &stripe.BillingPortalConfigurationFeaturesSubscriptionCancelParams{
+					Enabled: stripe.Bool(true),
+					Mode:    stripe.String(string(stripe.BillingPortalConfigurationFeaturesSubscriptionCancelModeAtPeriodEnd)),
+				},
+			},
+			DefaultReturnURL: stripe.String(viper.GetString("stripe.portal.return-url")),
+		}
+		configuration, err := stripeClient.BillingPortalConfigurations.New(params)
+		if err != nil {
+			return stacktrace.Propagate(err, fmt.Sprintf("failed to configure billing portal for account country %s", accountCountry))
+		}
+		if err = c.BillingRepo.SetPortalConfigurationID(string(accountCountry), configuration.ID); err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	return nil
+}
+
+func (c *StripeController) getStripeSubscriptionFromSession(userID int64, checkoutSessionID string) (stripe.Subscription, ente.StripeAccountCountry, error) {
 	subscription, err := c.BillingRepo.GetUserSubscription(userID)
 	if err != nil {
-		return stripe.Subscription{}, stacktrace.Propagate(err, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(err, "")
 	}
-	var stripeClient *client.API
+	var accountCountry ente.StripeAccountCountry
 	if subscription.PaymentProvider == ente.Stripe {
-		stripeClient = c.StripeClients[subscription.Attributes.StripeAccountCountry]
+		accountCountry = subscription.Attributes.StripeAccountCountry
 	} else {
-		stripeClient = c.StripeClients[ente.DefaultStripeAccountCountry]
+		accountCountry = ente.DefaultStripeAccountCountry
 	}
+	stripeClient := c.StripeClients[accountCountry]
 	params := &stripe.CheckoutSessionParams{}
 	params.AddExpand("subscription")
 	checkoutSession, err := stripeClient.CheckoutSessions.Get(checkoutSessionID, params)
 	if err != nil {
-		return stripe.Subscription{}, stacktrace.Propagate(err, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(err, "")
 	}
 	if (*checkoutSession.Subscription).Status != stripe.SubscriptionStatusActive {
-		return stripe.Subscription{}, stacktrace.Propagate(&stripe.InvalidRequestError{}, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(&stripe.InvalidRequestError{}, "")
 	}
-	return *checkoutSession.Subscription, nil
+	return *checkoutSession.Subscription, accountCountry, nil
 }
 
 func (c *StripeController) getPriceIDFromSession(sessionID string) (string, error) {
@@ -554,22 +1100,31 @@ func (c *StripeController) getPriceIDFromSession(sessionID string) (string, erro
 	return "", stacktrace.Propagate(ente.ErrNotFound, "")
 }
 
-func (c *StripeController) getUserStripeSubscription(userID int64) (stripe.Subscription, error) {
+func (c *StripeController) getUserStripeSubscription(userID int64) (stripe.Subscription, ente.StripeAccountCountry, error) {
 	subscription, err := c.BillingRepo.GetUserSubscription(userID)
 	if err != nil {
-		return stripe.Subscription{}, stacktrace.Propagate(err, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(err, "")
 	}
 	if subscription.PaymentProvider != ente.Stripe {
-		return stripe.Subscription{}, stacktrace.Propagate(ente.ErrCannotSwitchPaymentProvider, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(ente.ErrCannotSwitchPaymentProvider, "")
 	}
-	client := c.StripeClients[subscription.Attributes.StripeAccountCountry]
+	accountCountry := subscription.Attributes.StripeAccountCountry
+	client := c.StripeClients[accountCountry]
 	stripeSubscription, err := client.Subscriptions.Get(subscription.OriginalTransactionID, nil)
 	if err != nil {
-		return stripe.Subscription{}, stacktrace.Propagate(err, "")
+		return stripe.Subscription{}, "", stacktrace.Propagate(err, "")
 	}
-	return *stripeSubscription, nil
+	return *stripeSubscription, accountCountry, nil
 }
 
+// getPlanAndAccount resolves a Stripe price ID to the ente.BillingPlan and
+// the account country that sells it, by scanning every configured account.
+// It's only safe to use where the caller doesn't already know which Stripe
+// account the price came from (e.g. validating a client-submitted
+// newStripeID against whatever account currently backs the subscription);
+// elsewhere prefer getPlanForAccount, since the same price ID string could
+// in principle be reused across two accounts and this would arbitrarily
+// return whichever one is scanned first.
 func (c *StripeController) getPlanAndAccount(stripeID string) (ente.BillingPlan, ente.StripeAccountCountry, error) {
 	for stripeAccountCountry, billingPlansCountryWise := range c.BillingPlansPerAccount {
 		for _, plans := range billingPlansCountryWise {
@@ -583,18 +1138,67 @@ func (c *StripeController) getPlanAndAccount(stripeID string) (ente.BillingPlan,
 	return ente.BillingPlan{}, "", stacktrace.Propagate(ente.ErrNotFound, "")
 }
 
-func (c *StripeController) getEnteSubscriptionFromStripeSubscription(userID int64, stripeSubscription stripe.Subscription) (ente.Subscription, error) {
+// getPlanForAccount resolves a Stripe price ID to the ente.BillingPlan sold
+// under the given account country. Unlike getPlanAndAccount, the reverse
+// lookup is keyed on (stripeID, accountCountry), so it can't resolve a price
+// ID against the wrong account if the same ID string is ever reused across
+// currencies/accounts.
+func (c *StripeController) getPlanForAccount(stripeID string, accountCountry ente.StripeAccountCountry) (ente.BillingPlan, error) {
+	for _, plans := range c.BillingPlansPerAccount[accountCountry] {
+		for _, plan := range plans {
+			if plan.StripeID == stripeID {
+				return plan, nil
+			}
+		}
+	}
+	return ente.BillingPlan{}, stacktrace.Propagate(ente.ErrNotFound, "")
+}
+
+// PlansForCurrency returns every billing plan sold under accountCountry
+// whose Currency matches currency, so the checkout entrypoint can offer a
+// user only the prices that'll actually be charged in their display
+// currency rather than conflating plans across currencies that happen to
+// share an account.
+func (c *StripeController) PlansForCurrency(accountCountry ente.StripeAccountCountry, currency string) []ente.BillingPlan {
+	var result []ente.BillingPlan
+	for _, plans := range c.BillingPlansPerAccount[accountCountry] {
+		for _, plan := range plans {
+			if plan.Currency == currency {
+				result = append(result, plan)
+			}
+		}
+	}
+	return result
+}
+
+func (c *StripeController) getEnteSubscriptionFromStripeSubscription(userID int64, accountCountry ente.StripeAccountCountry, stripeSubscription stripe.Subscription) (ente.Subscription, error) {
 	productID := stripeSubscription.Items.Data[0].Price.ID
-	plan, stripeAccountCountry, err := c.getPlanAndAccount(productID)
+	plan, err := c.getPlanForAccount(productID, accountCountry)
 	if err != nil {
 		return ente.Subscription{}, stacktrace.Propagate(err, "")
 	}
+	attributes := ente.SubscriptionAttributes{
+		CustomerID:           stripeSubscription.Customer.ID,
+		IsCancelled:          false,
+		StripeAccountCountry: accountCountry,
+		// Carry the current cancel-at-period-end flag forward so that
+		// ReplaceSubscription (called right after this by some callers)
+		// doesn't clobber it with a stale false.
+		CancelAtPeriodEnd: stripeSubscription.CancelAtPeriodEnd,
+	}
+	if stripeSubscription.Discount != nil {
+		// Surface any applied discount (e.g. a referral coupon) so the
+		// client can show "Free until <date>" instead of the plan's usual
+		// price.
+		attributes.DiscountID = stripeSubscription.Discount.ID
+		attributes.DiscountEnd = stripeSubscription.Discount.End * 1000 * 1000
+	}
 	s := ente.Subscription{
 		UserID:                userID,
 		PaymentProvider:       ente.Stripe,
 		ProductID:             productID,
 		Storage:               plan.Storage,
-		Attributes:            ente.SubscriptionAttributes{CustomerID: stripeSubscription.Customer.ID, IsCancelled: false, StripeAccountCountry: stripeAccountCountry},
+		Attributes:            attributes,
 		OriginalTransactionID: stripeSubscription.ID,
 		ExpiryTime:            stripeSubscription.CurrentPeriodEnd * 1000 * 1000,
 	}
@@ -614,6 +1218,32 @@ func (c *StripeController) UpdateBillingEmail(subscription ente.Subscription, ne
 	return nil
 }
 
+// OnAccountDeleted cancels the user's Stripe subscription (if any) and
+// deletes the Stripe Customer object so that no payment methods or other
+// PII linger on Stripe's side after account deletion. It also records a
+// tombstone so that a late `customer.subscription.deleted` webhook for this
+// subscription doesn't try to email a now-nonexistent user.
+//
+// If Stripe answers the subscription update in CancelSubAndDeleteCustomer
+// with a 404 or 400, that call returns without cancelling the subscription
+// or deleting the customer; the tombstone is still recorded.
+//
+// It must be called synchronously from wherever a user's account is
+// actually deleted, before the user row itself is removed.
+func (c *StripeController) OnAccountDeleted(userID int64, logger *log.Entry) error {
+	subscription, err := c.BillingRepo.GetUserSubscription(userID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if subscription.PaymentProvider != ente.Stripe {
+		return nil
+	}
+	if err = c.CancelSubAndDeleteCustomer(subscription, logger); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return stacktrace.Propagate(c.BillingRepo.TombstoneAccountDeletion(userID), "")
+}
+
 func (c *StripeController) CancelSubAndDeleteCustomer(subscription ente.Subscription, logger *log.Entry) error {
 	client := c.StripeClients[subscription.Attributes.StripeAccountCountry]
 	if !subscription.Attributes.IsCancelled {
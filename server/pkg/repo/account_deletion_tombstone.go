@@ -0,0 +1,26 @@
+package repo
+
+import "github.com/ente-io/stacktrace"
+
+// TombstoneAccountDeletion records that userID's account has been deleted,
+// so that a Stripe webhook arriving after the fact (e.g. the
+// `customer.subscription.deleted` triggered by our own cancellation) knows
+// not to try to act on a user that no longer exists.
+func (repo *BillingRepository) TombstoneAccountDeletion(userID int64) error {
+	_, err := repo.DB.Exec(`
+		INSERT INTO account_deletion_tombstones(user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING`, userID)
+	return stacktrace.Propagate(err, "")
+}
+
+// IsAccountDeletionTombstoned reports whether userID's account has already
+// been deleted via OnAccountDeleted.
+func (repo *BillingRepository) IsAccountDeletionTombstoned(userID int64) (bool, error) {
+	var exists bool
+	err := repo.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM account_deletion_tombstones WHERE user_id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return exists, nil
+}
@@ -0,0 +1,14 @@
+package repo
+
+import "github.com/ente-io/stacktrace"
+
+// UpdateSubscriptionCancelAtPeriodEnd records whether a user's subscription
+// is scheduled to cancel at the end of the current billing period. This is
+// a separate flag from the subscription's IsCancelled attribute, which
+// UpdateSubscriptionCancellationStatus sets.
+func (repo *BillingRepository) UpdateSubscriptionCancelAtPeriodEnd(userID int64, cancelAtPeriodEnd bool) error {
+	_, err := repo.DB.Exec(`
+		UPDATE subscriptions SET attributes = jsonb_set(attributes, '{cancelAtPeriodEnd}', to_jsonb($2::boolean))
+		WHERE user_id = $1`, userID, cancelAtPeriodEnd)
+	return stacktrace.Propagate(err, "")
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/stacktrace"
+)
+
+// GetOrCreatePastDueSince returns the time at which the given user's
+// subscription first went past_due, creating the tracking row (with the
+// current time) if one doesn't already exist.
+func (repo *BillingRepository) GetOrCreatePastDueSince(userID int64) (time.Time, error) {
+	var firstPastDueAt time.Time
+	err := repo.DB.QueryRow(`
+		INSERT INTO past_due_subscriptions(user_id, first_past_due_at)
+		VALUES ($1, now())
+		ON CONFLICT (user_id) DO UPDATE SET user_id = past_due_subscriptions.user_id
+		RETURNING first_past_due_at`, userID).Scan(&firstPastDueAt)
+	if err != nil {
+		return time.Time{}, stacktrace.Propagate(err, "")
+	}
+	return firstPastDueAt, nil
+}
+
+// SetPastDueLatestInvoice records the most recent unpaid invoice for a
+// tracked past-due subscription, so it can be voided if the grace period
+// expires.
+func (repo *BillingRepository) SetPastDueLatestInvoice(userID int64, invoiceID string) error {
+	_, err := repo.DB.Exec(`
+		UPDATE past_due_subscriptions SET latest_invoice_id = $2 WHERE user_id = $1`, userID, invoiceID)
+	return stacktrace.Propagate(err, "")
+}
+
+// ClearPastDueSince removes the delinquency tracking row for a user, if any.
+func (repo *BillingRepository) ClearPastDueSince(userID int64) error {
+	_, err := repo.DB.Exec(`DELETE FROM past_due_subscriptions WHERE user_id = $1`, userID)
+	return stacktrace.Propagate(err, "")
+}
+
+// GetLastReminderDay returns the last DunningReminderDays entry we've sent
+// an escalating reminder email for a tracked past-due subscription.
+func (repo *BillingRepository) GetLastReminderDay(userID int64) (int, error) {
+	var lastReminderDay int
+	err := repo.DB.QueryRow(`
+		SELECT last_reminder_day FROM past_due_subscriptions WHERE user_id = $1`, userID).Scan(&lastReminderDay)
+	return lastReminderDay, stacktrace.Propagate(err, "")
+}
+
+// SetLastReminderDay records the last DunningReminderDays entry we've sent
+// an escalating reminder email for, so the cron doesn't resend it on every
+// hourly run it's still current.
+func (repo *BillingRepository) SetLastReminderDay(userID int64, day int) error {
+	_, err := repo.DB.Exec(`
+		UPDATE past_due_subscriptions SET last_reminder_day = $2 WHERE user_id = $1`, userID, day)
+	return stacktrace.Propagate(err, "")
+}
+
+// GetAllPastDueSubscriptions returns every subscription that is currently
+// being tracked as past_due, for the dunning cron to scan.
+func (repo *BillingRepository) GetAllPastDueSubscriptions(ctx context.Context) ([]ente.PastDueSubscription, error) {
+	rows, err := repo.DB.QueryContext(ctx, `
+		SELECT s.user_id, s.attributes->>'stripeAccountCountry', p.latest_invoice_id, p.first_past_due_at, p.last_reminder_day
+		FROM past_due_subscriptions p
+		JOIN subscriptions s ON s.user_id = p.user_id`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	var result []ente.PastDueSubscription
+	for rows.Next() {
+		var sub ente.PastDueSubscription
+		var latestInvoiceID sql.NullString
+		if err = rows.Scan(&sub.UserID, &sub.StripeAccountCountry, &latestInvoiceID, &sub.FirstPastDueAt, &sub.LastReminderDay); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		sub.LatestInvoiceID = latestInvoiceID.String
+		result = append(result, sub)
+	}
+	return result, stacktrace.Propagate(rows.Err(), "")
+}
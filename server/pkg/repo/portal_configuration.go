@@ -0,0 +1,28 @@
+package repo
+
+import "github.com/ente-io/stacktrace"
+
+// SetPortalConfigurationID records the Stripe Billing Portal configuration
+// that should be used for customers billed through the given account
+// country, replacing whatever was previously stored.
+func (repo *BillingRepository) SetPortalConfigurationID(accountCountry string, configurationID string) error {
+	_, err := repo.DB.Exec(`
+		INSERT INTO stripe_portal_configurations(stripe_account_country, configuration_id)
+		VALUES ($1, $2)
+		ON CONFLICT (stripe_account_country) DO UPDATE SET configuration_id = $2`,
+		accountCountry, configurationID)
+	return stacktrace.Propagate(err, "")
+}
+
+// GetPortalConfigurationID returns the Stripe Billing Portal configuration
+// ID that's been published for the given account country, if any.
+func (repo *BillingRepository) GetPortalConfigurationID(accountCountry string) (string, error) {
+	var configurationID string
+	err := repo.DB.QueryRow(`
+		SELECT configuration_id FROM stripe_portal_configurations WHERE stripe_account_country = $1`,
+		accountCountry).Scan(&configurationID)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "")
+	}
+	return configurationID, nil
+}
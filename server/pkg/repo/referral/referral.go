@@ -0,0 +1,56 @@
+// Package referral tracks who referred whom and the one-off Stripe coupon
+// minted to reward a referrer once the referred user's subscription
+// produces its first paid invoice.
+package referral
+
+import (
+	"database/sql"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// Repository persists referral relationships and the credit granted for them.
+type Repository struct {
+	DB *sql.DB
+}
+
+// NewRepository returns a new instance of Repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db}
+}
+
+// RecordReferral remembers that referredUserID signed up via a referral
+// from referrerUserID, so their first paid invoice can grant referrerUserID
+// a credit. It's a no-op if a referral is already on record for the user.
+func (repo *Repository) RecordReferral(referredUserID int64, referrerUserID int64) error {
+	_, err := repo.DB.Exec(`
+		INSERT INTO referral_credits(referred_user_id, referrer_user_id)
+		VALUES ($1, $2)
+		ON CONFLICT (referred_user_id) DO NOTHING`, referredUserID, referrerUserID)
+	return stacktrace.Propagate(err, "")
+}
+
+// GetUngrantedReferrerID returns the userID who referred referredUserID, if
+// a referral is on record and its credit hasn't been granted yet.
+func (repo *Repository) GetUngrantedReferrerID(referredUserID int64) (int64, bool, error) {
+	var referrerUserID int64
+	err := repo.DB.QueryRow(`
+		SELECT referrer_user_id FROM referral_credits
+		WHERE referred_user_id = $1 AND coupon_id IS NULL`, referredUserID).Scan(&referrerUserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, stacktrace.Propagate(err, "")
+	}
+	return referrerUserID, true, nil
+}
+
+// MarkCreditGranted records the Stripe coupon minted for referredUserID's
+// referrer, so the credit is granted exactly once.
+func (repo *Repository) MarkCreditGranted(referredUserID int64, couponID string) error {
+	_, err := repo.DB.Exec(`
+		UPDATE referral_credits SET coupon_id = $2, granted_at = now()
+		WHERE referred_user_id = $1`, referredUserID, couponID)
+	return stacktrace.Propagate(err, "")
+}
@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// TryClaimEvent atomically records that we've started processing a Stripe
+// webhook event, keyed by the event's own ID. It returns claimed=false if
+// the event has already been seen before (i.e. this is a Stripe retry of a
+// delivery we already handled), in which case the caller should no-op. The
+// raw event body is kept alongside for a bounded window (see
+// PurgeOldStripeEvents) to aid debugging of webhook issues.
+func (repo *BillingRepository) TryClaimEvent(eventID string, eventType string, createdAt time.Time, payload []byte) (bool, error) {
+	result, err := repo.DB.Exec(`
+		INSERT INTO stripe_events(event_id, event_type, event_created_at, event_payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id) DO NOTHING`, eventID, eventType, createdAt, json.RawMessage(payload))
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return rowsAffected > 0, nil
+}
+
+// UnclaimEvent releases the claim taken by TryClaimEvent for an event whose
+// handler failed, so that Stripe's retry of the same event ID is treated as
+// a fresh delivery instead of being silently dropped as "already
+// processed". It's a no-op (not an error) if the event was already marked
+// processed by the time this runs, since then there's nothing to retry.
+func (repo *BillingRepository) UnclaimEvent(eventID string) error {
+	_, err := repo.DB.Exec(`DELETE FROM stripe_events WHERE event_id = $1 AND processed_at IS NULL`, eventID)
+	return stacktrace.Propagate(err, "")
+}
+
+// PurgeOldStripeEvents deletes stripe_events rows (including their raw
+// payload) older than olderThan, so the dedupe table doesn't grow
+// unboundedly while still giving us a window to debug recent webhook
+// issues. It's meant to be run periodically, e.g. daily.
+func (repo *BillingRepository) PurgeOldStripeEvents(olderThan time.Duration) error {
+	_, err := repo.DB.Exec(`DELETE FROM stripe_events WHERE event_created_at < $1`, time.Now().Add(-olderThan))
+	return stacktrace.Propagate(err, "")
+}
+
+// MarkEventProcessed records that a claimed event's side effects have been
+// fully applied. An event that is claimed but never marked processed (e.g.
+// because museum crashed mid-handler) keeps its claim, so Stripe's retries
+// of it are ignored; the replay CLI does not pick such events up, as it only
+// replays parked events.
+func (repo *BillingRepository) MarkEventProcessed(eventID string) error {
+	_, err := repo.DB.Exec(`UPDATE stripe_events SET processed_at = now() WHERE event_id = $1`, eventID)
+	return stacktrace.Propagate(err, "")
+}
+
+// IsStaleEvent reports whether eventCreatedAt is older than (or the same
+// as) the most recent event we've already applied to this subscription,
+// which would mean applying it now could clobber a newer state with an
+// older one because Stripe doesn't guarantee webhook delivery order.
+func (repo *BillingRepository) IsStaleEvent(stripeSubscriptionID string, eventCreatedAt time.Time) (bool, error) {
+	var lastAppliedEventAt *time.Time
+	err := repo.DB.QueryRow(`
+		SELECT last_applied_event_at FROM subscriptions WHERE original_transaction_id = $1`,
+		stripeSubscriptionID).Scan(&lastAppliedEventAt)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	if lastAppliedEventAt == nil {
+		return false, nil
+	}
+	return !eventCreatedAt.After(*lastAppliedEventAt), nil
+}
+
+// MarkEventApplied records eventCreatedAt as the most recent event that's
+// been applied to this subscription's billing state, for future
+// IsStaleEvent checks.
+func (repo *BillingRepository) MarkEventApplied(stripeSubscriptionID string, eventCreatedAt time.Time) error {
+	_, err := repo.DB.Exec(`
+		UPDATE subscriptions SET last_applied_event_at = $2
+		WHERE original_transaction_id = $1 AND (last_applied_event_at IS NULL OR last_applied_event_at < $2)`,
+		stripeSubscriptionID, eventCreatedAt)
+	return stacktrace.Propagate(err, "")
+}
+
+// ParkPendingEvent stashes a webhook event whose Stripe subscription isn't
+// known to us yet (most commonly a `customer.subscription.updated` that
+// arrives before the `checkout.session.completed` that will create the
+// subscription row), so it can be drained and replayed once the
+// subscription exists.
+func (repo *BillingRepository) ParkPendingEvent(stripeSubscriptionID string, eventID string, payload []byte) error {
+	_, err := repo.DB.Exec(`
+		INSERT INTO stripe_pending_events(stripe_subscription_id, event_id, event_payload)
+		VALUES ($1, $2, $3)`, stripeSubscriptionID, eventID, json.RawMessage(payload))
+	return stacktrace.Propagate(err, "")
+}
+
+// PendingEvent is a parked webhook event awaiting replay.
+type PendingEvent struct {
+	ID      int64
+	EventID string
+	Payload []byte
+}
+
+// DrainPendingEvents returns (and deletes) every event parked for the given
+// Stripe subscription ID, in the order they were received.
+func (repo *BillingRepository) DrainPendingEvents(stripeSubscriptionID string) ([]PendingEvent, error) {
+	rows, err := repo.DB.Query(`
+		WITH drained AS (
+			DELETE FROM stripe_pending_events WHERE stripe_subscription_id = $1
+			RETURNING id, event_id, event_payload
+		)
+		SELECT id, event_id, event_payload FROM drained ORDER BY id`, stripeSubscriptionID)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	var pending []PendingEvent
+	for rows.Next() {
+		var p PendingEvent
+		if err = rows.Scan(&p.ID, &p.EventID, &p.Payload); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		pending = append(pending, p)
+	}
+	return pending, stacktrace.Propagate(rows.Err(), "")
+}